@@ -8,22 +8,27 @@ package main
 
 import (
 	"bufio"
-	"crypto/rand"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	mathrand "math/rand"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/jvehent/service-go"
-	"github.com/streadway/amqp"
+	socks "golang.org/x/net/proxy"
 	"mig.ninja/mig"
 	"mig.ninja/mig/mig-agent/agentcontext"
+	"mig.ninja/mig/mig-agent/transport"
 	"mig.ninja/mig/modules"
 )
 
@@ -63,18 +68,42 @@ type Context struct {
 		RunAgentCommand, RunExternalCommand chan moduleOp
 		Results                             chan mig.Command
 	}
-	MQ struct {
-		// configuration
-		Host, User, Pass string
-		Port             int
-		// internal
-		UseTLS bool
-		conn   *amqp.Connection
-		Chan   *amqp.Channel
-		Bind   struct {
-			Queue, Key string
-			Chan       <-chan amqp.Delivery
-		}
+	// Transport is the agent's connection to the relay. It used to be a
+	// hard-coded streadway/amqp connection; it is now an interface so
+	// the agent can be deployed against transports other than AMQP (see
+	// the transport package). mqSupervisor replaces it on reconnect from
+	// a background goroutine, so reads and writes must go through
+	// getTransport()/setTransport() rather than this field directly.
+	Transport   transport.Transport
+	transportMu sync.Mutex
+	Relay       struct {
+		// Peers holds the list of relay URIs learned at runtime from the
+		// scheduler, in addition to the compiled-in AMQPBROKER. It is
+		// populated from mig.AgentPeerUpdate control messages delivered
+		// on the agent's existing queue and persisted to
+		// ctx.Agent.RunDir so it survives agent restarts. connectMQ
+		// tries these before falling back to the compiled default.
+		Peers []string
+
+		// Resolvers, when set, overrides the compiled-in DNSRESOLVERS
+		// list of "host:port" DNS resolver addresses used to dial the
+		// relay, bypassing the system resolver.
+		Resolvers []string
+
+		// Timeout and Heartbeat override the compiled-in MQTIMEOUT and
+		// MQHEARTBEAT values for the AMQP connection timeout and
+		// heartbeat interval. They are decoupled from ctx.Sleeper so a
+		// long-sleeping agent doesn't force the broker to keep an
+		// equally long heartbeat window open. Reported on the stats
+		// socket alongside the connected state.
+		Timeout, Heartbeat time.Duration
+
+		// connected reflects whether the agent currently holds a live
+		// connection to the relay. It is updated by mqSupervisor
+		// and read by the stats socket, so a lock must be obtained on
+		// the mutex before reading or writing it.
+		connected bool
+		sync.Mutex
 	}
 	OpID    float64       // ID of the current operation, used for tracking
 	Sleeper time.Duration // timer used when the agent has to sleep for a while
@@ -208,49 +237,39 @@ func Init(foreground, upgrade bool) (ctx Context, err error) {
 		panic(err)
 	}
 
+	ctx.Relay.Timeout = MQTIMEOUT
+	ctx.Relay.Heartbeat = MQHEARTBEAT
+
 	// parse the ACLs
 	ctx, err = initACL(ctx)
 	if err != nil {
 		panic(err)
 	}
 
-	connected := false
+	// load any relay peers learned from a previous run, so we try those
+	// before the compiled-in AMQPBROKER
+	ctx, err = loadPeers(ctx)
+	if err != nil {
+		ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("failed to load relay peers: %v", err)}.Info()
+	}
+
 	// connect to the message broker
 	//
 	// If any proxies have been configured, we try to use those first. If they fail, or
 	// no proxies have been setup, just attempt a direct connection.
-	for _, proxy := range PROXIES {
-		ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("Trying proxy %v for relay connection", proxy)}.Debug()
-		ctx, err = initMQ(ctx, true, proxy)
-		if err != nil {
-			ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("Failed to connect to relay using proxy %s: '%v'", proxy, err)}.Info()
-			continue
-		}
-		connected = true
-		goto mqdone
-	}
-	// Try and proxy that has been specified in the environment
-	ctx.Channels.Log <- mig.Log{Desc: "Trying proxies from environment for relay connection"}.Debug()
-	ctx, err = initMQ(ctx, true, "")
-	if err == nil {
-		connected = true
-		goto mqdone
-	} else {
-		ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("Failed to connect to relay using HTTP_PROXY: '%v'", err)}.Info()
-	}
-	// Fall back to a direct connection
-	ctx.Channels.Log <- mig.Log{Desc: "Trying direct relay connection"}.Debug()
-	ctx, err = initMQ(ctx, false, "")
-	if err == nil {
-		connected = true
-	} else {
-		ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("Failed to connect to relay directly: '%v'", err)}.Info()
-	}
-mqdone:
-	if !connected {
+	ctx, err = connectMQ(ctx)
+	if err != nil {
 		panic("Failed to connect to the relay")
 	}
 
+	// Watch the connection and channel for unexpected closures and
+	// transparently redial the relay when that happens.
+	go mqSupervisor(&ctx)
+
+	// Read commands and relay peer updates off the transport and route
+	// them accordingly.
+	go dispatchTransportMessages(&ctx)
+
 	// catch interrupts
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -303,39 +322,103 @@ func initACL(orig_ctx Context) (ctx Context, err error) {
 	return
 }
 
-func initMQ(orig_ctx Context, try_proxy bool, proxy string) (ctx Context, err error) {
+// splitProxyScheme splits a proxy string of the form "scheme://host:port"
+// into its scheme and "host:port". Proxies with no scheme prefix, the
+// historical format, are treated as "http" so existing CONNECT-proxy
+// configurations keep working unchanged.
+func splitProxyScheme(proxy string) (scheme, hostport string) {
+	for _, s := range []string{"socks5", "https", "http"} {
+		prefix := s + "://"
+		if strings.HasPrefix(proxy, prefix) {
+			return s, strings.TrimPrefix(proxy, prefix)
+		}
+	}
+	return "http", proxy
+}
+
+// connectProxy issues an HTTP CONNECT request for addr over conn and
+// verifies the proxy answered with a 2xx status line, leaving conn
+// ready to use as the tunnel to addr. It is shared by the plain and
+// TLS-wrapped CONNECT dialers; only the dialer differs in whether conn
+// is a bare TCP connection or one already wrapped in a TLS handshake
+// with the proxy.
+func connectProxy(conn net.Conn, addr string) error {
+	fmt.Fprintf(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	// verify status is 200, and flush the buffer
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if status == "" || len(status) < 12 {
+		return fmt.Errorf("Invalid status received from proxy: '%s'", status)
+	}
+	// 9th character in response should be "2"
+	// HTTP/1.0 200 Connection established
+	//          ^
+	if status[9] != '2' {
+		return fmt.Errorf("Invalid status received from proxy: '%s'", status[0:len(status)-2])
+	}
+	return nil
+}
+
+// proxyHost strips the port off a "host:port" proxy address, for use as
+// the TLS ServerName when connecting to an https:// proxy.
+func proxyHost(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// dialTransport builds a transport.Config for broker and dials it using
+// the transport implementation selected by TRANSPORTKIND, optionally
+// tunneling the connection through proxy the same way the legacy AMQP
+// dialer did.
+func dialTransport(orig_ctx Context, try_proxy bool, proxy string, broker string) (ctx Context, err error) {
 	ctx = orig_ctx
 	defer func() {
 		if e := recover(); e != nil {
-			err = fmt.Errorf("initMQ() -> %v", e)
+			err = fmt.Errorf("dialTransport() -> %v", e)
 		}
-		ctx.Channels.Log <- mig.Log{Desc: "leaving initMQ()"}.Debug()
+		ctx.Channels.Log <- mig.Log{Desc: "leaving dialTransport()"}.Debug()
 	}()
 
-	//Define the AMQP binding
-	ctx.MQ.Bind.Queue = fmt.Sprintf("mig.agt.%s", ctx.Agent.QueueLoc)
-	ctx.MQ.Bind.Key = fmt.Sprintf("mig.agt.%s", ctx.Agent.QueueLoc)
-
-	// parse the dial string and use TLS if using amqps
-	amqp_uri, err := amqp.ParseURI(AMQPBROKER)
-	if err != nil {
-		panic(err)
+	cfg := transport.Config{
+		Broker:            broker,
+		Queue:             fmt.Sprintf("mig.agt.%s", ctx.Agent.QueueLoc),
+		RoutingKey:        fmt.Sprintf("mig.agt.%s", ctx.Agent.QueueLoc),
+		UseTLS:            strings.HasPrefix(broker, "amqps://"),
+		TLSCert:           AGENTCERT,
+		TLSKey:            AGENTKEY,
+		TLSCA:             CACERT,
+		Heartbeat:         ctx.Relay.Heartbeat,
+		ConnectionTimeout: ctx.Relay.Timeout,
 	}
-	ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("AMQP: host=%s, port=%d, vhost=%s", amqp_uri.Host, amqp_uri.Port, amqp_uri.Vhost)}.Debug()
-	if amqp_uri.Scheme == "amqps" {
-		ctx.MQ.UseTLS = true
+
+	resolvers := ctx.Relay.Resolvers
+	if resolvers == nil {
+		resolvers = DNSRESOLVERS
 	}
+	dialer := newDNSDialer(resolvers)
 
-	// create an AMQP configuration with specific timers
-	var dialConfig amqp.Config
-	dialConfig.Heartbeat = 2 * ctx.Sleeper
 	if try_proxy {
-		// if in try_proxy mode, the agent will try to connect to the relay using a CONNECT proxy
-		// but because CONNECT is a HTTP method, not available in AMQP, we need to establish
-		// that connection ourselves, and give it back to the amqp.DialConfig method
+		// if in try_proxy mode, the agent will try to connect to the relay through a proxy.
+		// Bare "host:port" proxies are assumed to be plaintext HTTP CONNECT proxies; a proxy
+		// found via HTTP_PROXY keeps the scheme given there. Proxies prefixed with https:// use the same CONNECT exchange,
+		// but over a TLS session to the proxy itself. Proxies prefixed with socks5:// go
+		// through a SOCKS5 dialer instead, for egress that is SOCKS-only.
 		if proxy == "" {
-			// try to get the proxy from the environemnt (variable HTTP_PROXY)
-			target := "http://" + amqp_uri.Host + ":" + fmt.Sprintf("%d", amqp_uri.Port)
+			// try to get the proxy from the environment: HTTP_PROXY (and NO_PROXY
+			// exclusions) first, then ALL_PROXY/SOCKS_PROXY for SOCKS-only egress.
+			// Parse out the real host:port rather than handing broker's whole URI
+			// (user:pass and all) to ProxyFromEnvironment, or NO_PROXY matching
+			// ends up evaluated against garbage like "amqp" as the host.
+			brokerURL, err := url.Parse(broker)
+			if err != nil {
+				panic(err)
+			}
+			target := "http://" + brokerURL.Host
 			req, err := http.NewRequest("GET", target, nil)
 			if err != nil {
 				panic(err)
@@ -344,117 +427,358 @@ func initMQ(orig_ctx Context, try_proxy bool, proxy string) (ctx Context, err er
 			if err != nil {
 				panic(err)
 			}
-			if proxy_url == nil {
+			switch {
+			case proxy_url != nil:
+				proxy = proxy_url.Scheme + "://" + proxy_url.Host
+			case os.Getenv("ALL_PROXY") != "":
+				proxy = os.Getenv("ALL_PROXY")
+			case os.Getenv("SOCKS_PROXY") != "":
+				proxy = "socks5://" + os.Getenv("SOCKS_PROXY")
+			default:
 				panic("Failed to find a suitable proxy in environment")
 			}
-			proxy = proxy_url.Host
 			ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("Found proxy at %s", proxy)}.Debug()
 		}
-		ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("Connecting via proxy %s", proxy)}.Debug()
-		dialConfig.Dial = func(network, addr string) (conn net.Conn, err error) {
-			// connect to the proxy
-			conn, err = net.DialTimeout("tcp", proxy, 5*time.Second)
+		scheme, hostport := splitProxyScheme(proxy)
+		ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("Connecting via %s proxy %s", scheme, hostport)}.Debug()
+
+		switch scheme {
+		case "socks5":
+			socksDialer, err := socks.SOCKS5("tcp", hostport, nil, dialer)
 			if err != nil {
-				return
+				panic(err)
 			}
-			// write a CONNECT request in the tcp connection
-			fmt.Fprintf(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
-			// verify status is 200, and flush the buffer
-			status, err := bufio.NewReader(conn).ReadString('\n')
-			if err != nil {
-				return
+			cfg.Dial = func(network, addr string) (net.Conn, error) {
+				conn, err := socksDialer.Dial(network, addr)
+				if err == nil {
+					ctx.Agent.Env.IsProxied = true
+					ctx.Agent.Env.Proxy = scheme + "://" + hostport
+				}
+				return conn, err
 			}
-			if status == "" || len(status) < 12 {
-				err = fmt.Errorf("Invalid status received from proxy: '%s'", status[0:len(status)-2])
-				return
+		case "https":
+			cfg.Dial = func(network, addr string) (conn net.Conn, err error) {
+				// connect to the proxy, through the configured DNS resolvers if any
+				conn, err = dialer.Dial("tcp", hostport)
+				if err != nil {
+					return
+				}
+				tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyHost(hostport)})
+				if err = tlsConn.Handshake(); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				if err = connectProxy(tlsConn, addr); err != nil {
+					tlsConn.Close()
+					return nil, err
+				}
+				ctx.Agent.Env.IsProxied = true
+				ctx.Agent.Env.Proxy = scheme + "://" + hostport
+				return tlsConn, nil
 			}
-			// 9th character in response should be "2"
-			// HTTP/1.0 200 Connection established
-			//          ^
-			if status[9] != '2' {
-				err = fmt.Errorf("Invalid status received from proxy: '%s'", status[0:len(status)-2])
+		default:
+			cfg.Dial = func(network, addr string) (conn net.Conn, err error) {
+				// connect to the proxy, through the configured DNS resolvers if any
+				conn, err = dialer.Dial("tcp", hostport)
+				if err != nil {
+					return
+				}
+				if err = connectProxy(conn, addr); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				ctx.Agent.Env.IsProxied = true
+				ctx.Agent.Env.Proxy = scheme + "://" + hostport
 				return
 			}
-			ctx.Agent.Env.IsProxied = true
-			ctx.Agent.Env.Proxy = proxy
-			return
 		}
 	} else {
-		dialConfig.Dial = func(network, addr string) (net.Conn, error) {
-			return net.DialTimeout(network, addr, 5*time.Second)
-		}
+		cfg.Dial = dialer.Dial
 	}
 
-	if ctx.MQ.UseTLS {
-		ctx.Channels.Log <- mig.Log{Desc: "Loading AMQPS TLS parameters"}.Debug()
-		// import the client certificates
-		cert, err := tls.X509KeyPair(AGENTCERT, AGENTKEY)
-		if err != nil {
-			panic(err)
-		}
-
-		// import the ca cert
-		ca := x509.NewCertPool()
-		if ok := ca.AppendCertsFromPEM(CACERT); !ok {
-			panic("failed to import CA Certificate")
-		}
-		TLSconfig := tls.Config{Certificates: []tls.Certificate{cert},
-			RootCAs:            ca,
-			InsecureSkipVerify: false,
-			Rand:               rand.Reader}
-
-		dialConfig.TLSClientConfig = &TLSconfig
-	}
-	// Open AMQP connection
 	ctx.Channels.Log <- mig.Log{Desc: "Establishing connection to relay"}.Debug()
-	ctx.MQ.conn, err = amqp.DialConfig(AMQPBROKER, dialConfig)
+	ctx.Transport = transport.New(TRANSPORTKIND)
+	err = ctx.Transport.Dial(context.Background(), cfg)
 	if err != nil {
 		ctx.Channels.Log <- mig.Log{Desc: "Connection failed"}.Debug()
 		panic(err)
 	}
 
-	ctx.MQ.Chan, err = ctx.MQ.conn.Channel()
+	return
+}
+
+// connectMQ walks the list of candidate relays, learned peers first and
+// the compiled-in AMQPBROKER last, and for each one walks the same
+// proxy-preference chain used at startup: it tries each configured
+// proxy in turn, then a proxy discovered from the environment
+// (HTTP_PROXY, ALL_PROXY or SOCKS_PROXY), then falls back to a direct
+// connection. It is used both
+// by Init() for the initial connection and by mqSupervisor() when
+// redialing after the relay connection is lost.
+func connectMQ(orig_ctx Context) (ctx Context, err error) {
+	ctx = orig_ctx
+	brokers := append(append([]string{}, ctx.Relay.Peers...), AMQPBROKER)
+	for _, broker := range brokers {
+		ctx, err = connectMQBroker(ctx, broker)
+		if err == nil {
+			return
+		}
+		ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("Failed to connect to relay %s: '%v'", broker, err)}.Info()
+	}
+	return
+}
+
+// connectMQBroker tries to reach a single relay URI, in order: through
+// each configured proxy, through a proxy discovered from the
+// environment, and finally directly.
+func connectMQBroker(orig_ctx Context, broker string) (ctx Context, err error) {
+	ctx = orig_ctx
+	for _, proxy := range PROXIES {
+		ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("Trying proxy %v for relay connection", proxy)}.Debug()
+		ctx, err = dialTransport(ctx, true, proxy, broker)
+		if err != nil {
+			ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("Failed to connect to relay using proxy %s: '%v'", proxy, err)}.Info()
+			continue
+		}
+		return
+	}
+	ctx.Channels.Log <- mig.Log{Desc: "Trying proxies from environment for relay connection"}.Debug()
+	ctx, err = dialTransport(ctx, true, "", broker)
+	if err == nil {
+		return
+	}
+	ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("Failed to connect to relay using HTTP_PROXY: '%v'", err)}.Info()
+	ctx.Channels.Log <- mig.Log{Desc: "Trying direct relay connection"}.Debug()
+	ctx, err = dialTransport(ctx, false, "", broker)
 	if err != nil {
-		panic(err)
+		ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("Failed to connect to relay directly: '%v'", err)}.Info()
 	}
+	return
+}
 
-	// Limit the number of message the channel will receive at once
-	err = ctx.MQ.Chan.Qos(1, // prefetch count (in # of msg)
-		0,     // prefetch size (in bytes)
-		false) // is global
+// peersFilename is the name of the file, stored under ctx.Agent.RunDir,
+// used to persist the list of relay peers learned at runtime.
+const peersFilename = "mig-agent-peers.json"
 
-	_, err = ctx.MQ.Chan.QueueDeclare(ctx.MQ.Bind.Queue, // Queue name
-		true,  // is durable
-		false, // is autoDelete
-		false, // is exclusive
-		false, // is noWait
-		nil)   // AMQP args
+// loadPeers reads the list of learned relay peers from
+// ctx.Agent.RunDir, if present, into ctx.Relay.Peers. A missing file is
+// not an error: it just means no peers have been learned yet.
+func loadPeers(orig_ctx Context) (ctx Context, err error) {
+	ctx = orig_ctx
+	path := filepath.Join(ctx.Agent.RunDir, peersFilename)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
 	if err != nil {
-		panic(err)
+		return
 	}
+	err = json.Unmarshal(data, &ctx.Relay.Peers)
+	return
+}
 
-	err = ctx.MQ.Chan.QueueBind(ctx.MQ.Bind.Queue, // Queue name
-		ctx.MQ.Bind.Key,    // Routing key name
-		mig.Mq_Ex_ToAgents, // Exchange name
-		false,              // is noWait
-		nil)                // AMQP args
+// savePeers persists the current list of learned relay peers to
+// ctx.Agent.RunDir so it survives an agent restart.
+func savePeers(ctx Context) error {
+	path := filepath.Join(ctx.Agent.RunDir, peersFilename)
+	data, err := json.Marshal(ctx.Relay.Peers)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	return ioutil.WriteFile(path, data, 0640)
+}
 
-	// Consume AMQP message into channel
-	ctx.MQ.Bind.Chan, err = ctx.MQ.Chan.Consume(ctx.MQ.Bind.Queue, // queue name
-		"",    // some tag
-		false, // is autoAck
-		false, // is exclusive
-		false, // is noLocal
-		false, // is noWait
-		nil)   // AMQP args
-	if err != nil {
-		panic(err)
+// applyPeerUpdate merges an mig.AgentPeerUpdate control message,
+// published by the scheduler on the agent's existing queue to announce
+// added or removed relay endpoints, into ctx.Relay.Peers and persists
+// the result. It is invoked from the command dispatch loop when a
+// control message is received alongside regular moduleOp commands.
+func applyPeerUpdate(ctx Context, update mig.AgentPeerUpdate) (Context, error) {
+	peers := make(map[string]bool)
+	for _, p := range ctx.Relay.Peers {
+		peers[p] = true
+	}
+	for _, p := range update.Added {
+		peers[p] = true
+	}
+	for _, p := range update.Removed {
+		delete(peers, p)
+	}
+	// build a fresh slice rather than reusing the old backing array, so
+	// copies of ctx taken earlier keep a stable list of peers
+	ctx.Relay.Peers = make([]string, 0, len(peers))
+	for p := range peers {
+		ctx.Relay.Peers = append(ctx.Relay.Peers, p)
+	}
+	ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("learned %d relay peer(s)", len(ctx.Relay.Peers))}.Info()
+	return ctx, savePeers(ctx)
+}
+
+// getTransport returns the current Transport implementation. Reads must
+// go through this method rather than ctx.Transport directly, since
+// mqSupervisor can replace it concurrently from a background goroutine
+// on reconnect.
+func (c *Context) getTransport() transport.Transport {
+	c.transportMu.Lock()
+	defer c.transportMu.Unlock()
+	return c.Transport
+}
+
+// setTransport atomically replaces the current Transport implementation.
+func (c *Context) setTransport(t transport.Transport) {
+	c.transportMu.Lock()
+	c.Transport = t
+	c.transportMu.Unlock()
+}
+
+// peerUpdateType tags an mig.AgentPeerUpdate control message on the
+// agent's command queue, so dispatchTransportMessages can tell it apart
+// from a regular command body without guessing at the shape of either.
+const peerUpdateType = "agentPeerUpdate"
+
+// dispatchTransportMessages reads deliveries off the transport and
+// routes them: bodies tagged peerUpdateType are decoded as
+// mig.AgentPeerUpdate and applied via applyPeerUpdate, everything else
+// is forwarded unchanged to ctx.Channels.NewCommand. Without this loop
+// nothing ever reads the transport's consumer channel, so it's what
+// makes the scheduler's ability to publish relay peer updates actually
+// take effect. It is started once from Init() and, since the transport
+// consumer channel closes whenever mqSupervisor redials, it
+// re-subscribes for as long as the agent runs.
+func dispatchTransportMessages(ctx *Context) {
+	for {
+		deliveries, err := ctx.getTransport().Consume()
+		if err != nil {
+			ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("failed to consume from relay: %v, retrying", err)}.Info()
+			time.Sleep(time.Second)
+			continue
+		}
+		for body := range deliveries {
+			var envelope struct {
+				Type string `json:"type"`
+			}
+			if json.Unmarshal(body, &envelope) == nil && envelope.Type == peerUpdateType {
+				var update mig.AgentPeerUpdate
+				if err := json.Unmarshal(body, &update); err != nil {
+					ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("failed to parse relay peer update: %v", err)}.Info()
+					continue
+				}
+				ctx.Relay.Lock()
+				newRelay, err := applyPeerUpdate(*ctx, update)
+				if err != nil {
+					ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("failed to persist relay peers: %v", err)}.Info()
+				}
+				ctx.Relay.Peers = newRelay.Relay.Peers
+				ctx.Relay.Unlock()
+				continue
+			}
+			ctx.Channels.NewCommand <- body
+		}
+		// deliveries was closed, most likely because mqSupervisor is
+		// redialing the relay. Wait for it to reconnect before
+		// resubscribing against the new transport.
+		for !ctx.IsConnected() {
+			time.Sleep(mqResubscribeDelay)
+		}
 	}
+}
 
-	return
+// mqResubscribeDelay is how often dispatchTransportMessages polls
+// IsConnected() while waiting for mqSupervisor to restore the relay
+// connection after a drop.
+const mqResubscribeDelay = 100 * time.Millisecond
+
+// setConnected updates the connected state exposed to the stats socket.
+func (c *Context) setConnected(state bool) {
+	c.Relay.Lock()
+	c.Relay.connected = state
+	c.Relay.Unlock()
+}
+
+// IsConnected reports whether the agent currently believes it holds a
+// live connection to the relay. It is used by the stats socket handler.
+func (c *Context) IsConnected() bool {
+	c.Relay.Lock()
+	defer c.Relay.Unlock()
+	return c.Relay.connected
+}
+
+// mqSupervisor watches the relay connection for unexpected closures and
+// transparently redials it, restoring command delivery, whenever that
+// happens. It also logs a heartbeat on ctx.Relay.Heartbeat while the
+// connection is up, and logs reconnect loss/recovery. It is started
+// once from Init() and runs for the lifetime of the agent process.
+func mqSupervisor(ctx *Context) {
+	ctx.setConnected(true)
+	heartbeat := time.NewTicker(ctx.Relay.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		closeErr := ctx.getTransport().NotifyClose()
+
+		var e error
+	waitForClose:
+		for {
+			select {
+			case e = <-closeErr:
+				break waitForClose
+			case <-ctx.Channels.Terminate:
+				return
+			case <-heartbeat.C:
+				ctx.Channels.Log <- mig.Log{Desc: "heartbeat: relay connection alive"}.Debug()
+			}
+		}
+		ctx.setConnected(false)
+		ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("relay connection lost: %v, reconnecting", e)}.Info()
+
+		var attempt uint
+		for {
+			// connectMQ runs against a throwaway copy of *ctx, not ctx
+			// itself: ctx is shared with other goroutines (the command
+			// dispatcher, the stats socket), and dialTransport mutates
+			// Agent.Env as it goes, so redialing must not touch the live
+			// struct until a connection actually succeeds. Once it does,
+			// fold back only what changed, each under its own lock,
+			// instead of replacing the whole struct out from under
+			// whoever else is reading it concurrently.
+			//
+			// Take Relay's lock across the copy itself: ctx.Relay.Peers
+			// is mutated in place by dispatchTransportMessages under the
+			// same lock whenever the scheduler announces a peer update,
+			// so copying the struct without it races on that slice.
+			ctx.Relay.Lock()
+			ctxCopy := *ctx
+			ctx.Relay.Unlock()
+			newCtx, err := connectMQ(ctxCopy)
+			if err == nil {
+				ctx.setTransport(newCtx.Transport)
+				ctx.Agent.Lock()
+				ctx.Agent.Env.IsProxied = newCtx.Agent.Env.IsProxied
+				ctx.Agent.Env.Proxy = newCtx.Agent.Env.Proxy
+				ctx.Agent.Unlock()
+				ctx.setConnected(true)
+				ctx.Channels.Log <- mig.Log{Desc: "reconnected to relay"}.Info()
+				break
+			}
+			attempt++
+			backoff := mqBackoff(attempt)
+			ctx.Channels.Log <- mig.Log{Desc: fmt.Sprintf("reconnect attempt %d failed: %v, retrying in %v", attempt, err, backoff)}.Info()
+			time.Sleep(backoff)
+		}
+	}
+}
+
+// mqBackoff returns an exponentially increasing delay, capped at 5
+// minutes and randomized with jitter so that a fleet of agents that
+// lost their relay at the same time doesn't redial in lockstep.
+func mqBackoff(attempt uint) time.Duration {
+	const maxBackoff = 5 * time.Minute
+	base := time.Second * time.Duration(1<<attempt)
+	if base > maxBackoff || base <= 0 {
+		base = maxBackoff
+	}
+	jitter := time.Duration(mathrand.Int63n(int64(base) / 2))
+	return base/2 + jitter
 }
 
 func Destroy(ctx Context) (err error) {
@@ -465,7 +789,7 @@ func Destroy(ctx Context) (err error) {
 	close(ctx.Channels.Results)
 	// give one second for the goroutines to close
 	time.Sleep(1 * time.Second)
-	ctx.MQ.conn.Close()
+	ctx.getTransport().Close()
 	return
 }
 
@@ -0,0 +1,80 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// dnsDialer resolves hostnames against an explicit list of DNS resolver
+// addresses instead of the system resolver, for environments where the
+// system resolver might leak queries or be poisoned. Resolvers are
+// tried round-robin with a per-resolver timeout; when the list is empty
+// it falls back to the default resolver, preserving prior behavior.
+type dnsDialer struct {
+	resolvers []string
+	timeout   time.Duration
+	next      uint32
+}
+
+// newDNSDialer builds a dnsDialer over resolvers, each given as
+// "host:port".
+func newDNSDialer(resolvers []string) *dnsDialer {
+	return &dnsDialer{resolvers: resolvers, timeout: 5 * time.Second}
+}
+
+// Dial resolves addr's host against the configured resolvers (or the
+// system resolver if none are configured) and dials the resulting
+// address. It is used for both the direct connection to the relay and
+// the initial TCP connection to a CONNECT proxy.
+func (d *dnsDialer) Dial(network, addr string) (net.Conn, error) {
+	if len(d.resolvers) == 0 {
+		return net.DialTimeout(network, addr, d.timeout)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := d.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout(network, net.JoinHostPort(ip, port), d.timeout)
+}
+
+// lookup queries the configured resolvers round-robin until one
+// answers.
+func (d *dnsDialer) lookup(host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return host, nil
+	}
+	n := len(d.resolvers)
+	start := int(atomic.AddUint32(&d.next, 1)) % n
+	var lastErr error
+	for i := 0; i < n; i++ {
+		resolver := d.resolvers[(start+i)%n]
+		ctxt, cancel := context.WithTimeout(context.Background(), d.timeout)
+		r := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return net.DialTimeout(network, resolver, d.timeout)
+			},
+		}
+		addrs, err := r.LookupHost(ctxt, host)
+		cancel()
+		if err != nil || len(addrs) == 0 {
+			lastErr = err
+			continue
+		}
+		return addrs[0], nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no resolver returned an address for %s", host)
+	}
+	return "", lastErr
+}
@@ -0,0 +1,32 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDNSDialerLookupPassesThroughIPs(t *testing.T) {
+	d := newDNSDialer(nil)
+	got, err := d.lookup("127.0.0.1")
+	if err != nil {
+		t.Fatalf("lookup() error = %v", err)
+	}
+	if got != "127.0.0.1" {
+		t.Fatalf("lookup() = %q, want %q", got, "127.0.0.1")
+	}
+}
+
+func TestDNSDialerLookupFailsOverAndReturnsErrorWhenAllResolversFail(t *testing.T) {
+	// Neither address has anything listening, so every resolver attempt
+	// should fail fast; lookup must try all of them and then return an
+	// error instead of hanging or panicking.
+	d := newDNSDialer([]string{"127.0.0.1:1", "127.0.0.1:2"})
+	d.timeout = time.Second
+	_, err := d.lookup("example.com")
+	if err == nil {
+		t.Fatal("lookup() error = nil, want an error once every resolver fails")
+	}
+}
@@ -0,0 +1,34 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMqBackoff(t *testing.T) {
+	cases := []struct {
+		attempt  uint
+		min, max time.Duration
+	}{
+		{attempt: 0, min: 500 * time.Millisecond, max: time.Second},
+		{attempt: 1, min: time.Second, max: 2 * time.Second},
+		{attempt: 3, min: 4 * time.Second, max: 8 * time.Second},
+		// large attempts must stay capped at 5 minutes, never overflow
+		{attempt: 10, min: 150 * time.Second, max: 5 * time.Minute},
+		{attempt: 63, min: 150 * time.Second, max: 5 * time.Minute},
+		{attempt: 200, min: 150 * time.Second, max: 5 * time.Minute},
+	}
+	for _, c := range cases {
+		// mqBackoff jitters with math/rand, so sample a few times instead
+		// of asserting an exact value.
+		for i := 0; i < 20; i++ {
+			got := mqBackoff(c.attempt)
+			if got < c.min || got > c.max {
+				t.Fatalf("mqBackoff(%d) = %v, want in [%v, %v]", c.attempt, got, c.min, c.max)
+			}
+		}
+	}
+}
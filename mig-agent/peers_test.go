@@ -0,0 +1,51 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package main
+
+import (
+	"sort"
+	"testing"
+
+	"mig.ninja/mig"
+)
+
+func TestApplyPeerUpdate(t *testing.T) {
+	var ctx Context
+	ctx.Agent.RunDir = t.TempDir()
+	ctx.Channels.Log = make(chan mig.Log, 10)
+	ctx.Relay.Peers = []string{"relay-a:5672", "relay-b:5672"}
+
+	update := mig.AgentPeerUpdate{
+		Added:   []string{"relay-c:5672"},
+		Removed: []string{"relay-a:5672"},
+	}
+	newCtx, err := applyPeerUpdate(ctx, update)
+	if err != nil {
+		t.Fatalf("applyPeerUpdate() error = %v", err)
+	}
+
+	got := append([]string{}, newCtx.Relay.Peers...)
+	sort.Strings(got)
+	want := []string{"relay-b:5672", "relay-c:5672"}
+	if len(got) != len(want) {
+		t.Fatalf("applyPeerUpdate() peers = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("applyPeerUpdate() peers = %v, want %v", got, want)
+		}
+	}
+
+	// re-applying the same removal/addition should be a no-op, not
+	// duplicate or re-remove entries
+	again, err := applyPeerUpdate(newCtx, update)
+	if err != nil {
+		t.Fatalf("applyPeerUpdate() (second call) error = %v", err)
+	}
+	got = append([]string{}, again.Relay.Peers...)
+	sort.Strings(got)
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("applyPeerUpdate() re-applied peers = %v, want %v", got, want)
+	}
+}
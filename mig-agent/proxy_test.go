@@ -0,0 +1,66 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestSplitProxyScheme(t *testing.T) {
+	cases := []struct {
+		proxy            string
+		scheme, hostport string
+	}{
+		{"socks5://10.0.0.1:1080", "socks5", "10.0.0.1:1080"},
+		{"https://proxy.example.com:8443", "https", "proxy.example.com:8443"},
+		{"http://proxy.example.com:3128", "http", "proxy.example.com:3128"},
+		{"proxy.example.com:3128", "http", "proxy.example.com:3128"},
+	}
+	for _, c := range cases {
+		scheme, hostport := splitProxyScheme(c.proxy)
+		if scheme != c.scheme || hostport != c.hostport {
+			t.Errorf("splitProxyScheme(%q) = (%q, %q), want (%q, %q)",
+				c.proxy, scheme, hostport, c.scheme, c.hostport)
+		}
+	}
+}
+
+// proxyPipe returns one end of a net.Pipe wired to a goroutine that
+// drains whatever is written to it (the CONNECT request) and replies
+// with statusLine.
+func proxyPipe(t *testing.T, statusLine string) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		bufio.NewReader(server).ReadString('\n')
+		fmt.Fprint(server, statusLine)
+		server.Close()
+	}()
+	return client
+}
+
+func TestConnectProxy(t *testing.T) {
+	cases := []struct {
+		name       string
+		statusLine string
+		wantErr    bool
+	}{
+		{"established", "HTTP/1.1 200 Connection established\r\n", false},
+		{"authRequired", "HTTP/1.1 407 Proxy Authentication Required\r\n", true},
+		{"tooShort", "bad\r\n", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := proxyPipe(t, c.statusLine)
+			defer conn.Close()
+			err := connectProxy(conn, "relay.example.com:5671")
+			if (err != nil) != c.wantErr {
+				t.Fatalf("connectProxy() error = %v, wantErr %v", err, c.wantErr)
+			}
+		})
+	}
+}
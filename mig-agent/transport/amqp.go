@@ -0,0 +1,140 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/streadway/amqp"
+	"mig.ninja/mig"
+)
+
+// amqpTransport is the historical, and still default, Transport
+// implementation: it talks to a RabbitMQ relay over AMQP.
+type amqpTransport struct {
+	conn *amqp.Connection
+	chn  *amqp.Channel
+	cfg  Config
+}
+
+func (t *amqpTransport) Dial(ctx context.Context, cfg Config) error {
+	t.cfg = cfg
+
+	amqpURI, err := amqp.ParseURI(cfg.Broker)
+	if err != nil {
+		return err
+	}
+
+	var dialConfig amqp.Config
+	dialConfig.Heartbeat = cfg.Heartbeat
+	dialConfig.ConnectionTimeout = cfg.ConnectionTimeout
+	if cfg.Dial != nil {
+		dialConfig.Dial = cfg.Dial
+	}
+
+	if cfg.UseTLS || amqpURI.Scheme == "amqps" {
+		cert, err := tls.X509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return err
+		}
+		ca := x509.NewCertPool()
+		if ok := ca.AppendCertsFromPEM(cfg.TLSCA); !ok {
+			return fmt.Errorf("failed to import CA certificate")
+		}
+		dialConfig.TLSClientConfig = &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			RootCAs:            ca,
+			InsecureSkipVerify: false,
+			Rand:               rand.Reader,
+		}
+	}
+
+	t.conn, err = amqp.DialConfig(cfg.Broker, dialConfig)
+	if err != nil {
+		return err
+	}
+
+	t.chn, err = t.conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	err = t.chn.Qos(1, 0, false)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.chn.QueueDeclare(cfg.Queue, true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	err = t.chn.QueueBind(cfg.Queue, cfg.RoutingKey, mig.Mq_Ex_ToAgents, false, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *amqpTransport) Consume() (<-chan []byte, error) {
+	// autoAck is left false, and Qos caps the channel to one outstanding
+	// delivery at a time, so every amqp.Delivery read here must be acked
+	// before the broker will deliver the next one. The Transport
+	// interface only carries the message body across the boundary, so
+	// there is no way for a caller further down the dispatch chain to
+	// ack a specific delivery; ack immediately on receipt instead. This
+	// trades at-least-once for at-most-once delivery, which matches what
+	// the rest of the agent already assumes (commands aren't redelivered
+	// on an agent crash today either).
+	deliveries, err := t.chn.Consume(t.cfg.Queue, "", false, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan []byte)
+	go func() {
+		for d := range deliveries {
+			d.Ack(false)
+			out <- d.Body
+		}
+		close(out)
+	}()
+	return out, nil
+}
+
+func (t *amqpTransport) Publish(routingKey string, body []byte) error {
+	return t.chn.Publish(mig.Mq_Ex_ToSchedulers, routingKey, false, false, amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		Body:         body,
+	})
+}
+
+func (t *amqpTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *amqpTransport) NotifyClose() <-chan error {
+	out := make(chan error, 1)
+	connClose := make(chan *amqp.Error, 1)
+	chanClose := make(chan *amqp.Error, 1)
+	t.conn.NotifyClose(connClose)
+	t.chn.NotifyClose(chanClose)
+	go func() {
+		select {
+		case e := <-connClose:
+			out <- amqpErrOrNil(e)
+		case e := <-chanClose:
+			out <- amqpErrOrNil(e)
+		}
+	}()
+	return out
+}
+
+func amqpErrOrNil(e *amqp.Error) error {
+	if e == nil {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,109 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsTransport is a Transport implementation for deployments that run
+// a NATS server instead of RabbitMQ. RoutingKey maps onto the NATS
+// subject and Queue onto the queue group name, and the agent uses a
+// queue subscription so only one agent instance answers a given subject
+// if several share a queue name.
+type natsTransport struct {
+	conn *nats.Conn
+	sub  *nats.Subscription
+	cfg  Config
+}
+
+func (t *natsTransport) Dial(ctx context.Context, cfg Config) error {
+	t.cfg = cfg
+
+	opts := []nats.Option{
+		nats.Timeout(cfg.ConnectionTimeout),
+		nats.PingInterval(cfg.Heartbeat),
+	}
+	if cfg.Dial != nil {
+		opts = append(opts, nats.SetCustomDialer(dialerFunc(cfg.Dial)))
+	}
+	if cfg.UseTLS {
+		cert, err := tls.X509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return err
+		}
+		ca := x509.NewCertPool()
+		if ok := ca.AppendCertsFromPEM(cfg.TLSCA); !ok {
+			return fmt.Errorf("failed to import CA certificate")
+		}
+		opts = append(opts, nats.Secure(&tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      ca,
+		}))
+	}
+
+	conn, err := nats.Connect(cfg.Broker, opts...)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	return nil
+}
+
+func (t *natsTransport) Consume() (<-chan []byte, error) {
+	msgs := make(chan *nats.Msg, 64)
+	sub, err := t.conn.ChanQueueSubscribe(t.cfg.RoutingKey, t.cfg.Queue, msgs)
+	if err != nil {
+		return nil, err
+	}
+	t.sub = sub
+	out := make(chan []byte)
+	go func() {
+		for m := range msgs {
+			out <- m.Data
+		}
+		close(out)
+	}()
+	return out, nil
+}
+
+func (t *natsTransport) Publish(routingKey string, body []byte) error {
+	return t.conn.Publish(routingKey, body)
+}
+
+func (t *natsTransport) Close() error {
+	if t.sub != nil {
+		t.sub.Unsubscribe()
+	}
+	t.conn.Close()
+	return nil
+}
+
+// NotifyClose reports only the connection's terminal closure, once the
+// nats.Conn client has exhausted its own built-in reconnect attempts
+// (Dial leaves auto-reconnect enabled, so NATS already rides out
+// transient blips on its own). SetDisconnectErrHandler is deliberately
+// left unused here: it fires on every transient disconnect, and feeding
+// those into the same channel mqSupervisor treats as "build a whole new
+// transport" would spin up a second connection on top of the one
+// already reconnecting underneath it.
+func (t *natsTransport) NotifyClose() <-chan error {
+	out := make(chan error, 1)
+	t.conn.SetClosedHandler(func(c *nats.Conn) {
+		out <- fmt.Errorf("nats connection closed")
+	})
+	return out
+}
+
+// dialerFunc adapts a func(network, addr string) (net.Conn, error),
+// such as the one built by the agent's proxy-aware dialer, into the
+// nats.CustomDialer interface expected by nats.SetCustomDialer.
+type dialerFunc func(network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, address string) (net.Conn, error) {
+	return f(network, address)
+}